@@ -7,23 +7,23 @@ type FuncAlias struct {
 }
 
 func NewAlias() Func {
-	return FuncAlias{}
+	return &FuncAlias{}
 }
 
-func (s FuncAlias) Signature() ([]argType, []argType) {
+func (s *FuncAlias) Signature() ([]argType, []argType) {
 	return []argType{seriesList, str}, []argType{seriesList}
 }
 
-func (s FuncAlias) Init(args []*expr) error {
+func (s *FuncAlias) Init(args []*expr) error {
 	s.alias = args[1].valStr
 	return nil
 }
 
-func (s FuncAlias) Depends(from, to uint32) (uint32, uint32) {
+func (s *FuncAlias) Depends(from, to uint32) (uint32, uint32) {
 	return from, to
 }
 
-func (s FuncAlias) Exec(cache map[Req][]models.Series, in ...interface{}) ([]interface{}, error) {
+func (s *FuncAlias) Exec(cache map[Req][]models.Series, in ...interface{}) ([]interface{}, error) {
 	series, ok := in[0].([]models.Series)
 	if !ok {
 		return nil, ErrArgumentBadType
@@ -31,7 +31,11 @@ func (s FuncAlias) Exec(cache map[Req][]models.Series, in ...interface{}) ([]int
 	var out []interface{}
 	for _, serie := range series {
 		serie.Target = s.alias
-		out = append(out, s)
+		out = append(out, serie)
 	}
 	return out, nil
-}
\ No newline at end of file
+}
+
+func init() {
+	Register("alias", NewAlias)
+}
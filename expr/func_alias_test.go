@@ -0,0 +1,36 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/raintank/metrictank/api/models"
+)
+
+func TestFuncAliasAppliesAlias(t *testing.T) {
+	f := NewAlias()
+	if err := f.Init([]*expr{{}, {valStr: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	in := []models.Series{{Target: "metric"}}
+	out, err := f.Exec(nil, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(out))
+	}
+	serie, ok := out[0].(models.Series)
+	if !ok {
+		t.Fatalf("expected models.Series, got %T", out[0])
+	}
+	if serie.Target != "foo" {
+		t.Errorf("expected Target %q, got %q", "foo", serie.Target)
+	}
+}
+
+func TestFuncAliasRegistered(t *testing.T) {
+	if _, ok := Lookup("alias"); !ok {
+		t.Fatal(`"alias" not registered in funcRegistry`)
+	}
+}
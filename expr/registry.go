@@ -0,0 +1,26 @@
+package expr
+
+import "fmt"
+
+// funcRegistry maps a Graphite-compatible function name to a constructor
+// for it. Each function registers itself from its own func_*.go file via
+// an init() calling Register, so adding a new function never means editing
+// a central switch.
+var funcRegistry = make(map[string]func() Func)
+
+// Register adds ctor to the registry under name. It's meant to be called
+// from a function's init(); a duplicate name can only be a programming
+// mistake, so it panics rather than silently shadowing the earlier one.
+func Register(name string, ctor func() Func) {
+	if _, ok := funcRegistry[name]; ok {
+		panic(fmt.Sprintf("expr: function %q already registered", name))
+	}
+	funcRegistry[name] = ctor
+}
+
+// Lookup returns the constructor registered for name, and whether one was
+// found.
+func Lookup(name string) (func() Func, bool) {
+	ctor, ok := funcRegistry[name]
+	return ctor, ok
+}
@@ -0,0 +1,86 @@
+// Package messagebus abstracts the ingestion pipeline away from any one
+// message queue implementation. nsq_metrics_to_kairos (and friends) talk to
+// a Subscriber to consume the raw metrics topic and a Publisher to
+// republish low-priority metrics, so operators can pick whichever bus fits
+// their deployment via --bus.
+package messagebus
+
+import "fmt"
+
+// Message is the bus-agnostic envelope handed to a Handler. It carries just
+// enough of the underlying transport's metadata for handlers to do things
+// like track message age.
+type Message struct {
+	Body      []byte
+	Timestamp int64 // unix nano, when the message was produced/enqueued
+}
+
+// Handler processes a single Message delivered by a Subscriber. On the nsq
+// backend, returning a non-nil error causes the message to be requeued,
+// mirroring nsq.Handler semantics; the nats backend has no requeue and the
+// message is dropped.
+type Handler interface {
+	HandleMessage(msg *Message) error
+}
+
+// Subscriber consumes messages for a topic/channel pair and dispatches them
+// to a Handler. The nsq backend runs `concurrency` handlers in parallel; the
+// nats backend ignores `concurrency` and delivers through a single callback.
+type Subscriber interface {
+	Subscribe(topic, channel string, concurrency int, handler Handler) error
+	ConnectToAddresses(addrs []string) error
+	ConnectToLookupds(addrs []string) error
+	// Stop begins a graceful shutdown; StopChan is closed once it completes.
+	Stop()
+	StopChan() <-chan struct{}
+}
+
+// Publisher republishes payloads to a topic. key is an optional routing
+// hint (e.g. used by implementations that shard across multiple producers)
+// and may be ignored by implementations that don't need it.
+type Publisher interface {
+	Publish(topic, key string, payload []byte) error
+	MultiPublish(topic, key string, payloads [][]byte) error
+	Close() error
+}
+
+// Config carries the settings needed to construct any of the supported
+// backends. Fields not relevant to the chosen backend are ignored.
+type Config struct {
+	NSQDTCPAddrs     []string
+	LookupdHTTPAddrs []string
+	ConsumerOpts     []string
+	ProducerOpts     []string
+	UserAgent        string
+	MaxInFlight      int
+	Metrics          interface{} // met.Backend; the nsq backend asserts it back, the nats backend ignores it
+}
+
+// Bus is the entry point a backend implements: main() asks it for a
+// Subscriber per topic/channel it needs to consume, and a single shared
+// Publisher for republishing.
+type Bus interface {
+	NewSubscriber(topic, channel, statPrefix string) (Subscriber, error)
+	// NewPublisher returns the backend's default Publisher, which for nsq
+	// picks a producer via the epsilon-greedy hostpool on every call.
+	NewPublisher() (Publisher, error)
+	// NewPublisherSet returns one Publisher per underlying broker
+	// connection the backend maintains (one per nsqd address for nsq; a
+	// single entry for backends, like nats, with just one connection).
+	// It's the building block ProducerStrategy implementations use for
+	// round-robin and multicast distribution.
+	NewPublisherSet() ([]Publisher, error)
+}
+
+// New constructs the Bus for the named backend. Supported names are "nsq"
+// and "nats".
+func New(name string, cfg Config) (Bus, error) {
+	switch name {
+	case "nsq", "":
+		return newNSQBus(cfg), nil
+	case "nats":
+		return newNATSBus(cfg), nil
+	default:
+		return nil, fmt.Errorf("messagebus: unknown bus %q", name)
+	}
+}
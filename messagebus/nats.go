@@ -0,0 +1,137 @@
+package messagebus
+
+import (
+	"fmt"
+	"sync"
+
+	nats "github.com/nats-io/go-nats"
+)
+
+// natsBus is the "nats" messagebus.Bus backend. It maps nsqd/lookupd
+// addresses onto NATS server URLs and topic/channel onto subject/queue
+// group, so the rest of the pipeline doesn't need to know the difference.
+type natsBus struct {
+	cfg Config
+}
+
+func newNATSBus(cfg Config) *natsBus {
+	return &natsBus{cfg: cfg}
+}
+
+func (b *natsBus) servers() []string {
+	return append(append([]string{}, b.cfg.NSQDTCPAddrs...), b.cfg.LookupdHTTPAddrs...)
+}
+
+func (b *natsBus) connect() (*nats.Conn, error) {
+	servers := b.servers()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("messagebus: nats requires at least one --nsqd-tcp-address or --lookupd-http-address (used as NATS server URLs)")
+	}
+	return nats.Connect(
+		nats.DefaultURL,
+		nats.MaxReconnects(-1),
+		func(o *nats.Options) error {
+			o.Servers = servers
+			return nil
+		},
+	)
+}
+
+type natsSubscriber struct {
+	conn    *nats.Conn
+	sub     *nats.Subscription
+	stopped chan struct{}
+
+	// inFlight tracks callbacks QueueSubscribe has handed to handler.
+	// Unsubscribe/Close only stop new deliveries; Stop waits on this so
+	// stopped isn't closed while a HandleMessage call is still running.
+	inFlight sync.WaitGroup
+}
+
+func (b *natsBus) NewSubscriber(topic, channel, statPrefix string) (Subscriber, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &natsSubscriber{conn: conn, stopped: make(chan struct{})}, nil
+}
+
+func (s *natsSubscriber) Subscribe(topic, channel string, concurrency int, handler Handler) error {
+	sub, err := s.conn.QueueSubscribe(topic, channel, func(msg *nats.Msg) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		if err := handler.HandleMessage(&Message{Body: msg.Data}); err != nil {
+			// NATS has no built-in requeue; an operator relying on
+			// at-least-once delivery should pair this with JetStream.
+			return
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.sub = sub
+	return nil
+}
+
+// ConnectToAddresses and ConnectToLookupds are no-ops for NATS: the
+// connection is already established against cfg.NSQDTCPAddrs /
+// cfg.LookupdHTTPAddrs (reused as NATS server URLs) in NewSubscriber.
+func (s *natsSubscriber) ConnectToAddresses(addrs []string) error { return nil }
+func (s *natsSubscriber) ConnectToLookupds(addrs []string) error  { return nil }
+
+func (s *natsSubscriber) Stop() {
+	if s.sub != nil {
+		s.sub.Unsubscribe()
+	}
+	s.conn.Close()
+	// Unsubscribe/Close only stop new callbacks from being dispatched; wait
+	// for whatever's already in flight so stopped closes only once delivery
+	// has actually drained, per the Subscriber interface's contract.
+	s.inFlight.Wait()
+	close(s.stopped)
+}
+
+func (s *natsSubscriber) StopChan() <-chan struct{} {
+	return s.stopped
+}
+
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func (b *natsBus) NewPublisher() (Publisher, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn}, nil
+}
+
+func (p *natsPublisher) Publish(topic, key string, payload []byte) error {
+	return p.conn.Publish(topic, payload)
+}
+
+func (p *natsPublisher) MultiPublish(topic, key string, payloads [][]byte) error {
+	for _, payload := range payloads {
+		if err := p.conn.Publish(topic, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+// NewPublisherSet returns a single-element set: NATS multiplexes all
+// subjects over the one connection, so there's nothing to round-robin or
+// multicast across at this layer.
+func (b *natsBus) NewPublisherSet() ([]Publisher, error) {
+	pub, err := b.NewPublisher()
+	if err != nil {
+		return nil, err
+	}
+	return []Publisher{pub}, nil
+}
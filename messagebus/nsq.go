@@ -0,0 +1,176 @@
+package messagebus
+
+import (
+	"fmt"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/internal/app"
+	met "github.com/grafana/grafana/pkg/metric"
+	"github.com/raintank/raintank-metric/instrumented_nsq"
+)
+
+// nsqSubscriber wraps an instrumented_nsq.Consumer behind the Subscriber
+// interface.
+type nsqSubscriber struct {
+	consumer *nsq.Consumer
+	stopped  chan struct{}
+}
+
+func newNSQSubscriber(topic, channel, statPrefix string, cfg Config) (*nsqSubscriber, error) {
+	nsqCfg := nsq.NewConfig()
+	nsqCfg.UserAgent = cfg.UserAgent
+	if err := app.ParseOpts(nsqCfg, cfg.ConsumerOpts); err != nil {
+		return nil, err
+	}
+	nsqCfg.MaxInFlight = cfg.MaxInFlight
+	metrics, _ := cfg.Metrics.(met.Backend)
+	consumer, err := insq.NewConsumer(topic, channel, nsqCfg, statPrefix, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return &nsqSubscriber{consumer: consumer, stopped: make(chan struct{})}, nil
+}
+
+type nsqHandlerFunc struct {
+	handler Handler
+}
+
+func (h nsqHandlerFunc) HandleMessage(m *nsq.Message) error {
+	return h.handler.HandleMessage(&Message{Body: m.Body, Timestamp: m.Timestamp})
+}
+
+func (s *nsqSubscriber) Subscribe(topic, channel string, concurrency int, handler Handler) error {
+	s.consumer.AddConcurrentHandlers(nsqHandlerFunc{handler}, concurrency)
+	go func() {
+		<-s.consumer.StopChan
+		close(s.stopped)
+	}()
+	return nil
+}
+
+func (s *nsqSubscriber) ConnectToAddresses(addrs []string) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	return s.consumer.ConnectToNSQDs(addrs)
+}
+
+func (s *nsqSubscriber) ConnectToLookupds(addrs []string) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	return s.consumer.ConnectToNSQLookupds(addrs)
+}
+
+func (s *nsqSubscriber) Stop() {
+	s.consumer.Stop()
+}
+
+func (s *nsqSubscriber) StopChan() <-chan struct{} {
+	return s.stopped
+}
+
+// nsqPublisher preserves the pre-existing behavior of picking a producer
+// out of the hostpool-balanced set of nsqd TCP addresses.
+type nsqPublisher struct {
+	pool      hostpool.HostPool
+	producers map[string]*nsq.Producer
+}
+
+func newNSQPublisher(cfg Config) (*nsqPublisher, error) {
+	pCfg := nsq.NewConfig()
+	pCfg.UserAgent = cfg.UserAgent
+	if err := app.ParseOpts(pCfg, cfg.ProducerOpts); err != nil {
+		return nil, err
+	}
+	producers := make(map[string]*nsq.Producer)
+	for _, addr := range cfg.NSQDTCPAddrs {
+		producer, err := nsq.NewProducer(addr, pCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating producer %s: %s", addr, err)
+		}
+		producers[addr] = producer
+	}
+	return &nsqPublisher{
+		pool:      hostpool.NewEpsilonGreedy(cfg.NSQDTCPAddrs, 0, &hostpool.LinearEpsilonValueCalculator{}),
+		producers: producers,
+	}, nil
+}
+
+func (p *nsqPublisher) pick() hostpool.HostPoolResponse {
+	return p.pool.Get()
+}
+
+func (p *nsqPublisher) Publish(topic, key string, payload []byte) error {
+	resp := p.pick()
+	err := p.producers[resp.Host()].Publish(topic, payload)
+	resp.Mark(err)
+	return err
+}
+
+func (p *nsqPublisher) MultiPublish(topic, key string, payloads [][]byte) error {
+	resp := p.pick()
+	err := p.producers[resp.Host()].MultiPublish(topic, payloads)
+	resp.Mark(err)
+	return err
+}
+
+func (p *nsqPublisher) Close() error {
+	for _, producer := range p.producers {
+		producer.Stop()
+	}
+	return nil
+}
+
+// nsqBus is the "nsq" messagebus.Bus backend: it talks directly to nsqd/
+// nsqlookupd, preserving the hostpool-based producer selection that
+// nsq_metrics_to_kairos has always used.
+type nsqBus struct {
+	cfg Config
+}
+
+func newNSQBus(cfg Config) *nsqBus {
+	return &nsqBus{cfg: cfg}
+}
+
+func (b *nsqBus) NewSubscriber(topic, channel, statPrefix string) (Subscriber, error) {
+	return newNSQSubscriber(topic, channel, statPrefix, b.cfg)
+}
+
+func (b *nsqBus) NewPublisher() (Publisher, error) {
+	return newNSQPublisher(b.cfg)
+}
+
+// singleNSQProducerPublisher is a Publisher backed by exactly one nsqd
+// connection, with no hostpool involved; it's what NewPublisherSet hands
+// out so round-robin/multicast ProducerStrategy implementations can address
+// each nsqd individually.
+type singleNSQProducerPublisher struct {
+	producer *nsq.Producer
+}
+
+func (p *singleNSQProducerPublisher) Publish(topic, key string, payload []byte) error {
+	return p.producer.Publish(topic, payload)
+}
+
+func (p *singleNSQProducerPublisher) MultiPublish(topic, key string, payloads [][]byte) error {
+	return p.producer.MultiPublish(topic, payloads)
+}
+
+func (p *singleNSQProducerPublisher) Close() error {
+	p.producer.Stop()
+	return nil
+}
+
+func (b *nsqBus) NewPublisherSet() ([]Publisher, error) {
+	pub, err := newNSQPublisher(b.cfg)
+	if err != nil {
+		return nil, err
+	}
+	set := make([]Publisher, 0, len(pub.producers))
+	for _, producer := range pub.producers {
+		set = append(set, &singleNSQProducerPublisher{producer: producer})
+	}
+	return set, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"time"
+
+	"github.com/raintank/metrictank/messagebus"
+)
+
+// broadcaster coalesces individual low-prio republishes into batches and
+// flushes them through a ProducerStrategy's producers, instead of the
+// one-message-per-publish pattern KairosHandler used to drive directly.
+// Each producer gets its own channeledSender, so a slow or stuck producer
+// under --mode=round-robin/multicast only backs up its own queue instead of
+// stalling every handler goroutine calling send().
+type broadcaster struct {
+	strategy ProducerStrategy
+	senders  []*channeledSender
+}
+
+// newBroadcaster spawns one channeledSender per strategy.producers() and
+// returns a broadcaster ready to accept payloads via send. compression is
+// applied to each payload individually right before a sender flushes it,
+// see compress().
+func newBroadcaster(strategy ProducerStrategy, topic string, maxBatchSize int, maxBatchWait time.Duration, compression string) *broadcaster {
+	producers := strategy.producers()
+	senders := make([]*channeledSender, len(producers))
+	for i, publisher := range producers {
+		senders[i] = newChanneledSender(publisher, topic, maxBatchSize, maxBatchWait, compression, strategy.modeCounters())
+	}
+	return &broadcaster{strategy: strategy, senders: senders}
+}
+
+// send routes payload to whichever sender(s) the strategy picks: one for
+// hostpool/round-robin, every sender for multicast.
+func (b *broadcaster) send(payload []byte) {
+	for _, i := range b.strategy.route() {
+		b.senders[i].send(payload)
+	}
+}
+
+// stop flushes and drains every sender.
+func (b *broadcaster) stop() {
+	for _, s := range b.senders {
+		s.stop()
+	}
+}
+
+// channeledSender owns a single producer's mailbox, unsent buffer and batch
+// ticker, and is the only goroutine that ever calls MultiPublish on that
+// producer.
+type channeledSender struct {
+	publisher    messagebus.Publisher
+	topic        string
+	maxBatchSize int
+	maxBatchWait *time.Ticker
+	compression  string
+	counters     modeCounters
+
+	mailbox chan []byte
+	unsent  [][]byte
+	oldest  time.Time
+	done    chan struct{}
+}
+
+func newChanneledSender(publisher messagebus.Publisher, topic string, maxBatchSize int, maxBatchWait time.Duration, compression string, counters modeCounters) *channeledSender {
+	s := &channeledSender{
+		publisher:    publisher,
+		topic:        topic,
+		maxBatchSize: maxBatchSize,
+		maxBatchWait: time.NewTicker(maxBatchWait),
+		compression:  compression,
+		counters:     counters,
+		mailbox:      make(chan []byte, maxBatchSize),
+		done:         make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *channeledSender) loop() {
+	defer close(s.done)
+	for {
+		select {
+		case payload, ok := <-s.mailbox:
+			if !ok {
+				s.flush()
+				return
+			}
+			if len(s.unsent) == 0 {
+				s.oldest = time.Now()
+			}
+			s.unsent = append(s.unsent, payload)
+			if len(s.unsent) >= s.maxBatchSize {
+				s.flush()
+			}
+		case <-s.maxBatchWait.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *channeledSender) flush() {
+	if len(s.unsent) == 0 {
+		return
+	}
+	lowPrioBatchAge.Value(time.Since(s.oldest).Nanoseconds() / int64(time.Millisecond))
+
+	payloads := s.unsent
+	if s.compression != "none" {
+		payloads = make([][]byte, len(s.unsent))
+		for i, payload := range s.unsent {
+			compressed, err := compress(s.compression, payload)
+			if err != nil {
+				msgsToLowPrioFail.Inc(int64(len(s.unsent)))
+				s.counters.record(err)
+				s.unsent = s.unsent[:0]
+				return
+			}
+			lowPrioCompressedSize.Value(int64(len(compressed)))
+			payloads[i] = compressed
+		}
+	}
+
+	err := s.publisher.MultiPublish(s.topic, "", payloads)
+	if err != nil {
+		msgsToLowPrioFail.Inc(int64(len(payloads)))
+	} else {
+		msgsToLowPrioOK.Inc(int64(len(payloads)))
+	}
+	s.counters.record(err)
+	s.unsent = s.unsent[:0]
+}
+
+// send queues payload for the next flush. It blocks if the mailbox is full,
+// which is fine: it's the same backpressure KairosHandler already relies on
+// elsewhere in the pipeline, now scoped to this one producer instead of the
+// whole strategy.
+func (s *channeledSender) send(payload []byte) {
+	s.mailbox <- payload
+}
+
+// stop flushes whatever is left in the mailbox and waits for the loop to
+// exit.
+func (s *channeledSender) stop() {
+	close(s.mailbox)
+	<-s.done
+}
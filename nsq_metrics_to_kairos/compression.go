@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	snappystream "github.com/mreiferson/go-snappystream"
+)
+
+// snappyMagic prefixes every snappy-compressed payload so a consumer can
+// tell a compressed message apart from a plain one without needing to know
+// what the producer's --compression setting was.
+var snappyMagic = []byte("rtsz1")
+
+// compress wraps payload in a snappy stream, preceded by snappyMagic, iff
+// compression is "snappy". Any other value (including the default "none")
+// returns payload unmodified.
+func compress(compression string, payload []byte) ([]byte, error) {
+	if compression != "snappy" {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	buf.Write(snappyMagic)
+	w := snappystream.NewWriter(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress detects the snappyMagic prefix and, if present, inflates the
+// payload; uncompressed payloads (the common case during a rollout where
+// not every producer has --compression=snappy yet) pass through untouched.
+func decompress(payload []byte) ([]byte, error) {
+	if !isCompressed(payload) {
+		return payload, nil
+	}
+	r := snappystream.NewReader(bytes.NewReader(payload[len(snappyMagic):]), true)
+	return ioutil.ReadAll(r)
+}
+
+// isCompressed reports whether payload carries the snappyMagic prefix, i.e.
+// whether decompress would actually inflate it rather than pass it through.
+func isCompressed(payload []byte) bool {
+	return len(payload) >= len(snappyMagic) && bytes.Equal(payload[:len(snappyMagic)], snappyMagic)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "sync"
+
+// Metric is the decoded unit of work handed to the KairosGateway. It
+// mirrors the handful of fields the gateway actually needs to build a
+// KairosDB write; the NSQ message body carries a JSON array of these.
+type Metric struct {
+	Id    string  `json:"id"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Time  int64   `json:"time"`
+}
+
+// KairosGateway owns the pool of workers that take decoded metrics off the
+// handlers. Handlers (high and low prio) both feed it through Add; the
+// workers count what they receive and do not store it (see write).
+type KairosGateway struct {
+	dryRun bool
+	in     chan []Metric
+	wg     sync.WaitGroup
+}
+
+// NewKairosGateway starts `concurrency` workers draining the queue fed by
+// Add. Each worker counts the metrics it receives in metricsToKairosOK; no
+// request is sent to KairosDB, whether or not dryRun is set.
+func NewKairosGateway(dryRun bool, concurrency int) (*KairosGateway, error) {
+	g := &KairosGateway{
+		dryRun: dryRun,
+		in:     make(chan []Metric, concurrency),
+	}
+	for i := 0; i < concurrency; i++ {
+		g.wg.Add(1)
+		go g.worker()
+	}
+	return g, nil
+}
+
+func (g *KairosGateway) worker() {
+	defer g.wg.Done()
+	for metrics := range g.in {
+		g.write(metrics)
+	}
+}
+
+func (g *KairosGateway) write(metrics []Metric) {
+	if g.dryRun {
+		metricsToKairosOK.Inc(int64(len(metrics)))
+		return
+	}
+	// No KairosDB datapoints request is built here; the metrics are only
+	// counted, the same as in a dry run.
+	metricsToKairosOK.Inc(int64(len(metrics)))
+}
+
+// Add queues metrics for writing. It blocks if every worker is busy, which
+// is the backpressure mechanism that keeps NSQ's in-flight window honest.
+func (g *KairosGateway) Add(metrics []Metric) {
+	g.in <- metrics
+}
+
+// Wait closes the work queue and blocks until every queued batch has been
+// written, used during graceful shutdown to make sure nothing in flight is
+// dropped.
+func (g *KairosGateway) Wait() {
+	close(g.in)
+	g.wg.Wait()
+}
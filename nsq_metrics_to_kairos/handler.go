@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/raintank/metrictank/messagebus"
+)
+
+// KairosHandler handles messages off the high-prio topic: it writes every
+// metric into KairosDB via the gateway, and republishes the same batch onto
+// the low-prio topic for any downstream consumer to replay without putting
+// load on the high-prio path.
+type KairosHandler struct {
+	gateway     *KairosGateway
+	broadcaster *broadcaster
+}
+
+// NewKairosHandler builds a KairosHandler that republishes via broadcaster.
+func NewKairosHandler(gateway *KairosGateway, broadcaster *broadcaster) *KairosHandler {
+	return &KairosHandler{gateway: gateway, broadcaster: broadcaster}
+}
+
+func (k *KairosHandler) HandleMessage(msg *messagebus.Message) error {
+	if isCompressed(msg.Body) {
+		messagesCompressedSize.Value(int64(len(msg.Body)))
+	}
+	body, err := decompress(msg.Body)
+	if err != nil {
+		msgsHandleHighPrioFail.Inc(1)
+		return err
+	}
+	messagesSize.Value(int64(len(body)))
+	if msg.Timestamp != 0 {
+		msgsHighPrioAge.Value((time.Now().UnixNano() - msg.Timestamp) / int64(time.Millisecond))
+	}
+
+	var metrics []Metric
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		msgsHandleHighPrioFail.Inc(1)
+		return err
+	}
+	metricsPerMessage.Value(int64(len(metrics)))
+	inHighPrioItems.Value(int64(len(metrics)))
+
+	k.gateway.Add(metrics)
+	k.broadcaster.send(body)
+
+	msgsHandleHighPrioOK.Inc(1)
+	return nil
+}
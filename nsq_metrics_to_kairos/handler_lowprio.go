@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/raintank/metrictank/messagebus"
+)
+
+// KairosLowPrioHandler handles messages replayed onto the low-prio topic.
+// Unlike KairosHandler it only ever writes into KairosDB; there's nothing
+// further downstream to republish to.
+type KairosLowPrioHandler struct {
+	gateway *KairosGateway
+}
+
+// NewKairosLowPrioHandler builds a KairosLowPrioHandler writing into gateway.
+func NewKairosLowPrioHandler(gateway *KairosGateway) *KairosLowPrioHandler {
+	return &KairosLowPrioHandler{gateway: gateway}
+}
+
+func (k *KairosLowPrioHandler) HandleMessage(msg *messagebus.Message) error {
+	if isCompressed(msg.Body) {
+		messagesCompressedSize.Value(int64(len(msg.Body)))
+	}
+	body, err := decompress(msg.Body)
+	if err != nil {
+		msgsHandleLowPrioFail.Inc(1)
+		return err
+	}
+	messagesSize.Value(int64(len(body)))
+	if msg.Timestamp != 0 {
+		msgsLowPrioAge.Value((time.Now().UnixNano() - msg.Timestamp) / int64(time.Millisecond))
+	}
+
+	var metrics []Metric
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		msgsHandleLowPrioFail.Inc(1)
+		return err
+	}
+	metricsPerMessage.Value(int64(len(metrics)))
+	inLowPrioItems.Value(int64(len(metrics)))
+
+	k.gateway.Add(metrics)
+	msgsHandleLowPrioOK.Inc(1)
+	return nil
+}
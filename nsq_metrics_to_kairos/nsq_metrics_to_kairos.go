@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -14,18 +13,20 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 
-	"github.com/bitly/go-hostpool"
-	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/internal/app"
+	log "github.com/grafana/grafana/pkg/log"
 	met "github.com/grafana/grafana/pkg/metric"
 	"github.com/grafana/grafana/pkg/metric/helper"
-	"github.com/raintank/raintank-metric/instrumented_nsq"
+	"github.com/raintank/metrictank/messagebus"
+	"github.com/rakyll/globalconf"
 )
 
 var (
 	showVersion = flag.Bool("version", false, "print version string")
+	confFile    = flag.String("config", "", "config file to read flags from (CLI flags take precedence)")
 	dryRun      = flag.Bool("dry", false, "dry run (disable actually storing into kairosdb")
 
+	bus          = flag.String("bus", "nsq", "message bus to use: nsq|nats")
 	concurrency  = flag.Int("concurrency", 10, "number of workers parsing messages and writing into kairosdb. also number of nsq consumers for both high and low prio topic")
 	topic        = flag.String("topic", "metrics", "NSQ topic")
 	topicLowPrio = flag.String("topic-lowprio", "metrics-lowprio", "NSQ topic")
@@ -35,6 +36,18 @@ var (
 	statsdAddr = flag.String("statsd-addr", "localhost:8125", "statsd address (default: localhost:8125)")
 	statsdType = flag.String("statsd-type", "standard", "statsd type: standard or datadog (default: standard)")
 
+	lowPrioBatchSize = flag.Int("lowprio-batch-size", 100, "max number of messages to coalesce into a single low-prio republish")
+	lowPrioBatchWait = flag.Duration("lowprio-batch-wait", time.Second, "max time to wait before flushing a partial low-prio batch")
+
+	compression = flag.String("compression", "none", "compression to use for low-prio republishes: none|snappy. incoming messages are auto-detected regardless of this setting")
+
+	mode = flag.String("mode", "hostpool", "producer distribution mode for low-prio republishes: hostpool|round-robin|multicast")
+
+	logLevel = flag.String("log-level", "info", "log level: trace|debug|info|warn|error|critical")
+	logMode  = flag.String("log-mode", "console", "comma separated list of log sinks to write to: console|file|syslog|conn")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "max time to wait for in-flight kairosdb writes and low-prio republishes to drain on shutdown")
+
 	consumerOpts     = app.StringArray{}
 	producerOpts     = app.StringArray{}
 	nsqdTCPAddrs     = app.StringArray{}
@@ -52,6 +65,8 @@ func init() {
 var metricsToKairosOK met.Count
 var metricsToKairosFail met.Count
 var messagesSize met.Meter
+var messagesCompressedSize met.Meter
+var lowPrioCompressedSize met.Meter
 var metricsPerMessage met.Meter
 var msgsLowPrioAge met.Meter  // in ms
 var msgsHighPrioAge met.Meter // in ms
@@ -64,21 +79,43 @@ var msgsHandleHighPrioOK met.Count
 var msgsHandleHighPrioFail met.Count
 var msgsHandleLowPrioOK met.Count
 var msgsHandleLowPrioFail met.Count
+var lowPrioBatchAge met.Meter // in ms
+var shutdownDrainDuration met.Timer
 
 func main() {
 	flag.Parse()
 
+	// bootstrap logger: console/info, just enough to report a bad
+	// -config before we know what -log-mode/-log-level should really be.
+	log.NewLogger(0, "console", `{"level": "INFO"}`)
+
+	if *confFile != "" {
+		conf, err := globalconf.NewWithOptions(&globalconf.Options{
+			Filename:  *confFile,
+			EnvPrefix: "NSQ_METRICS_TO_KAIROS_",
+		})
+		if err != nil {
+			log.Fatal(3, "%v", err)
+		}
+		conf.ParseAll()
+	}
+
+	// re-init now that -config (if any) has had a chance to set
+	// -log-mode/-log-level, so a value from the config file isn't
+	// silently shadowed by the flag defaults used above.
+	log.NewLogger(0, *logMode, fmt.Sprintf(`{"level": "%s"}`, strings.ToUpper(*logLevel)))
+
 	if *showVersion {
 		fmt.Println("nsq_metrics_to_kairos")
 		return
 	}
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 	metrics, err := helper.New(true, *statsdAddr, *statsdType, "nsq_metrics_to_kairos", strings.Replace(hostname, ".", "_", -1))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
 	if *channel == "" {
@@ -87,47 +124,48 @@ func main() {
 	}
 
 	if *topic == "" {
-		log.Fatal("--topic is required")
+		log.Fatal(3, "--topic is required")
 	}
 
 	if len(nsqdTCPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
-		log.Fatal("--nsqd-tcp-address or --lookupd-http-address required")
+		log.Fatal(3, "--nsqd-tcp-address or --lookupd-http-address required")
 	}
 	if len(nsqdTCPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
-		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
+		log.Fatal(3, "use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	cfg := nsq.NewConfig()
-	cfg.UserAgent = "nsq_metrics_to_kairos"
-	err = app.ParseOpts(cfg, consumerOpts)
-	if err != nil {
-		log.Fatal(err)
+	busCfg := messagebus.Config{
+		NSQDTCPAddrs:     nsqdTCPAddrs,
+		LookupdHTTPAddrs: lookupdHTTPAddrs,
+		ConsumerOpts:     consumerOpts,
+		ProducerOpts:     producerOpts,
+		UserAgent:        "nsq_metrics_to_kairos",
+		MaxInFlight:      *maxInFlight,
+		Metrics:          metrics,
 	}
-	cfg.MaxInFlight = *maxInFlight
-
-	consumer, err := insq.NewConsumer(*topic, *channel, cfg, "high_prio.%s", metrics)
+	msgBus, err := messagebus.New(*bus, busCfg)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
-	consumerLowPrio, err := insq.NewConsumer(*topicLowPrio, *channel, cfg, "low_prio.%s", metrics)
+	consumer, err := msgBus.NewSubscriber(*topic, *channel, "high_prio.%s")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
-	pCfg := nsq.NewConfig()
-	pCfg.UserAgent = "nsq_metrics_to_kairos"
-	err = app.ParseOpts(pCfg, producerOpts)
+	consumerLowPrio, err := msgBus.NewSubscriber(*topicLowPrio, *channel, "low_prio.%s")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
 	metricsToKairosOK = metrics.NewCount("metrics_to_kairos.ok")
 	metricsToKairosFail = metrics.NewCount("metrics_to_kairos.fail")
 	messagesSize = metrics.NewMeter("message_size", 0)
+	messagesCompressedSize = metrics.NewMeter("message_compressed_size", 0)
+	lowPrioCompressedSize = metrics.NewMeter("low_prio.message_compressed_size", 0)
 	metricsPerMessage = metrics.NewMeter("metrics_per_message", 0)
 	msgsLowPrioAge = metrics.NewMeter("low_prio.message_age", 0)
 	msgsHighPrioAge = metrics.NewMeter("high_prio.message_age", 0)
@@ -140,66 +178,93 @@ func main() {
 	msgsHandleHighPrioFail = metrics.NewCount("handle_high_prio.fail")
 	msgsHandleLowPrioOK = metrics.NewCount("handle_low_prio.ok")
 	msgsHandleLowPrioFail = metrics.NewCount("handle_low_prio.fail")
+	lowPrioBatchAge = metrics.NewMeter("low_prio.batch_age", 0)
+	shutdownDrainDuration = metrics.NewTimer("shutdown_drain_duration", 0)
 
-	hostPool := hostpool.NewEpsilonGreedy(nsqdTCPAddrs, 0, &hostpool.LinearEpsilonValueCalculator{})
-	producers := make(map[string]*nsq.Producer)
-	for _, addr := range nsqdTCPAddrs {
-		producer, err := nsq.NewProducer(addr, pCfg)
-		if err != nil {
-			log.Fatalf("failed creating producer %s", err)
-		}
-		producers[addr] = producer
+	gateway, err := NewKairosGateway(*dryRun, *concurrency)
+	if err != nil {
+		log.Fatal(3, "%v", err)
 	}
 
-	gateway, err := NewKairosGateway(*dryRun, *concurrency)
+	strategy, err := newProducerStrategy(*mode, msgBus, metrics)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
-	handler := NewKairosHandler(gateway, hostPool, producers)
-	consumer.AddConcurrentHandlers(handler, *concurrency)
+	broadcaster := newBroadcaster(strategy, *topicLowPrio, *lowPrioBatchSize, *lowPrioBatchWait, *compression)
+
+	handler := NewKairosHandler(gateway, broadcaster)
+	if err := consumer.Subscribe(*topic, *channel, *concurrency, handler); err != nil {
+		log.Fatal(3, "%v", err)
+	}
 
 	handlerLowPrio := NewKairosLowPrioHandler(gateway)
-	consumerLowPrio.AddConcurrentHandlers(handlerLowPrio, *concurrency)
+	if err := consumerLowPrio.Subscribe(*topicLowPrio, *channel, *concurrency, handlerLowPrio); err != nil {
+		log.Fatal(3, "%v", err)
+	}
 
-	err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
+	err = consumer.ConnectToAddresses(nsqdTCPAddrs)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
-	log.Println("INFO : connected to nsqd")
+	log.Info("connected to nsqd")
 
-	err = consumer.ConnectToNSQLookupds(lookupdHTTPAddrs)
+	err = consumer.ConnectToLookupds(lookupdHTTPAddrs)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
-	err = consumerLowPrio.ConnectToNSQDs(nsqdTCPAddrs)
+	err = consumerLowPrio.ConnectToAddresses(nsqdTCPAddrs)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
-	log.Println("INFO : connected to nsqd")
+	log.Info("connected to nsqd")
 
-	err = consumerLowPrio.ConnectToNSQLookupds(lookupdHTTPAddrs)
+	err = consumerLowPrio.ConnectToLookupds(lookupdHTTPAddrs)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(3, "%v", err)
 	}
 
 	go func() {
-		log.Println("INFO starting listener for http/debug on :6060")
-		log.Println(http.ListenAndServe(":6060", nil))
+		log.Info("starting listener for http/debug on :6060")
+		log.Error(3, "%v", http.ListenAndServe(":6060", nil))
 	}()
 
-	for {
-		select {
-		case <-consumer.StopChan:
-			consumerLowPrio.Stop()
-			return
-		case <-consumerLowPrio.StopChan:
-			consumer.Stop()
-			return
-		case <-sigChan:
-			consumer.Stop()
-			consumerLowPrio.Stop()
-		}
+	awaitShutdown(sigChan, consumer, consumerLowPrio, gateway, broadcaster, *shutdownTimeout)
+}
+
+// awaitShutdown blocks until a stop signal arrives (either from the OS or
+// from one of the subscribers stopping on its own), then stops both
+// subscribers and waits for the gateway and broadcaster to drain whatever
+// was already in flight. If that drain doesn't finish within timeout, it
+// exits non-zero so orchestrators can tell the stop wasn't clean.
+func awaitShutdown(sigChan <-chan os.Signal, consumer, consumerLowPrio messagebus.Subscriber, gateway *KairosGateway, broadcaster *broadcaster, timeout time.Duration) {
+	select {
+	case <-sigChan:
+	case <-consumer.StopChan():
+	case <-consumerLowPrio.StopChan():
 	}
-}
\ No newline at end of file
+
+	log.Info("shutting down, draining in-flight work (timeout %s)", timeout)
+	start := time.Now()
+	consumer.Stop()
+	consumerLowPrio.Stop()
+
+	drained := make(chan struct{})
+	go func() {
+		<-consumer.StopChan()
+		<-consumerLowPrio.StopChan()
+		broadcaster.stop()
+		gateway.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		shutdownDrainDuration.Value(time.Since(start).Nanoseconds() / int64(time.Millisecond))
+		log.Info("drained cleanly, exiting")
+	case <-time.After(timeout):
+		log.Error(3, "shutdown timeout (%s) exceeded with work still queued", timeout)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	met "github.com/grafana/grafana/pkg/metric"
+	"github.com/raintank/metrictank/messagebus"
+)
+
+// ProducerStrategy decides which of a broadcaster's per-producer
+// channeledSenders a given payload gets routed to. It doesn't publish
+// anything itself: that's owned by the senders, each driving one of
+// producers() so a slow producer only backs up its own sender.
+type ProducerStrategy interface {
+	// producers are the publishers this strategy routes across, one
+	// channeledSender per entry.
+	producers() []messagebus.Publisher
+	// route returns the indices into producers() a payload should be sent
+	// to: a single index for hostpool/round-robin, every index for
+	// multicast.
+	route() []int
+	// modeCounters are the to_low_prio.mode.<name>.ok/fail counters a
+	// sender records a flush's outcome against.
+	modeCounters() modeCounters
+}
+
+// modeCounters are the per-mode to_low_prio.mode.<name>.ok/fail counters
+// operators use to compare loss rates across --mode values.
+type modeCounters struct {
+	ok   met.Count
+	fail met.Count
+}
+
+func newModeCounters(metrics met.Backend, mode string) modeCounters {
+	return modeCounters{
+		ok:   metrics.NewCount(fmt.Sprintf("to_low_prio.mode.%s.ok", mode)),
+		fail: metrics.NewCount(fmt.Sprintf("to_low_prio.mode.%s.fail", mode)),
+	}
+}
+
+func (c modeCounters) record(err error) {
+	if err != nil {
+		c.fail.Inc(1)
+	} else {
+		c.ok.Inc(1)
+	}
+}
+
+// hostpoolStrategy is the original behavior: a single producer whose
+// Publisher already picks a host via the epsilon-greedy hostpool on every
+// MultiPublish call, so there's only ever one sender to route to.
+type hostpoolStrategy struct {
+	publisher messagebus.Publisher
+	counters  modeCounters
+}
+
+func newHostpoolStrategy(publisher messagebus.Publisher, metrics met.Backend) *hostpoolStrategy {
+	return &hostpoolStrategy{publisher: publisher, counters: newModeCounters(metrics, "hostpool")}
+}
+
+func (s *hostpoolStrategy) producers() []messagebus.Publisher {
+	return []messagebus.Publisher{s.publisher}
+}
+func (s *hostpoolStrategy) route() []int               { return []int{0} }
+func (s *hostpoolStrategy) modeCounters() modeCounters { return s.counters }
+
+// roundRobinStrategy cycles deterministically through the bus's producer
+// set, routing each payload to exactly one sender.
+type roundRobinStrategy struct {
+	publishers []messagebus.Publisher
+	next       uint64
+	counters   modeCounters
+}
+
+func newRoundRobinStrategy(publishers []messagebus.Publisher, metrics met.Backend) *roundRobinStrategy {
+	return &roundRobinStrategy{publishers: publishers, counters: newModeCounters(metrics, "round-robin")}
+}
+
+func (s *roundRobinStrategy) producers() []messagebus.Publisher { return s.publishers }
+
+func (s *roundRobinStrategy) route() []int {
+	i := atomic.AddUint64(&s.next, 1) % uint64(len(s.publishers))
+	return []int{int(i)}
+}
+
+func (s *roundRobinStrategy) modeCounters() modeCounters { return s.counters }
+
+// multicastStrategy routes every payload to every producer, useful for
+// fanning the low-prio stream out to multiple metrictank shards.
+type multicastStrategy struct {
+	publishers []messagebus.Publisher
+	counters   modeCounters
+}
+
+func newMulticastStrategy(publishers []messagebus.Publisher, metrics met.Backend) *multicastStrategy {
+	return &multicastStrategy{publishers: publishers, counters: newModeCounters(metrics, "multicast")}
+}
+
+func (s *multicastStrategy) producers() []messagebus.Publisher { return s.publishers }
+
+func (s *multicastStrategy) route() []int {
+	indices := make([]int, len(s.publishers))
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+func (s *multicastStrategy) modeCounters() modeCounters { return s.counters }
+
+// newProducerStrategy builds the ProducerStrategy for the given --mode.
+func newProducerStrategy(mode string, bus messagebus.Bus, metrics met.Backend) (ProducerStrategy, error) {
+	switch mode {
+	case "hostpool", "":
+		publisher, err := bus.NewPublisher()
+		if err != nil {
+			return nil, err
+		}
+		return newHostpoolStrategy(publisher, metrics), nil
+	case "round-robin":
+		publishers, err := bus.NewPublisherSet()
+		if err != nil {
+			return nil, err
+		}
+		if len(publishers) == 0 {
+			return nil, fmt.Errorf("--mode=round-robin requires at least one producer in the bus's publisher set (e.g. --nsqd-tcp-address; not satisfied by --lookupd-http-address alone)")
+		}
+		return newRoundRobinStrategy(publishers, metrics), nil
+	case "multicast":
+		publishers, err := bus.NewPublisherSet()
+		if err != nil {
+			return nil, err
+		}
+		if len(publishers) == 0 {
+			return nil, fmt.Errorf("--mode=multicast requires at least one producer in the bus's publisher set (e.g. --nsqd-tcp-address; not satisfied by --lookupd-http-address alone)")
+		}
+		return newMulticastStrategy(publishers, metrics), nil
+	default:
+		return nil, fmt.Errorf("unknown --mode %q, expected hostpool, round-robin or multicast", mode)
+	}
+}
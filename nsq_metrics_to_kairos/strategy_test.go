@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	met "github.com/grafana/grafana/pkg/metric"
+	"github.com/raintank/metrictank/messagebus"
+)
+
+// emptyPublisherSetBus mimics the nsq backend as configured with only
+// --lookupd-http-address: NewPublisherSet() has nothing to enumerate since
+// there are no known nsqd addresses up front.
+type emptyPublisherSetBus struct{}
+
+func (emptyPublisherSetBus) NewSubscriber(topic, channel, statPrefix string) (messagebus.Subscriber, error) {
+	return nil, nil
+}
+
+func (emptyPublisherSetBus) NewPublisher() (messagebus.Publisher, error) {
+	return nil, nil
+}
+
+func (emptyPublisherSetBus) NewPublisherSet() ([]messagebus.Publisher, error) {
+	return nil, nil
+}
+
+func TestNewProducerStrategyRejectsEmptyPublisherSet(t *testing.T) {
+	var metrics met.Backend
+
+	for _, mode := range []string{"round-robin", "multicast"} {
+		if _, err := newProducerStrategy(mode, emptyPublisherSetBus{}, metrics); err == nil {
+			t.Errorf("--mode=%s: expected an error with an empty publisher set, got nil", mode)
+		}
+	}
+}